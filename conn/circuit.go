@@ -0,0 +1,113 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// breakerState is one of the three states of a sendController's circuit
+// breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	initialBackoff    = 100 * time.Millisecond
+	backoffMultiplier = 2
+	maxBackoff        = 30 * time.Second
+)
+
+// sendController tracks the backoff/circuit-breaker state for sends to a
+// single peer. BatchAndSendMessages keeps one of these per destination node,
+// so a peer that's been down for hours stops costing us a goroutine and a
+// gRPC call for every batch, and stops spamming the log once its breaker
+// opens.
+//
+// The breaker starts closed (sends allowed). Each send failure opens the
+// breaker for a fully-jittered window of up to the current backoff, then
+// widens the backoff (exponential, capped at maxBackoff) for the next
+// failure, so the first window is at most initialBackoff; while open, BatchAndSendMessages
+// drops messages to this peer instead of sending them. Once the window
+// elapses, the breaker goes half-open and allows exactly one probe send; a
+// successful probe closes the breaker and resets the backoff, a failed one
+// reopens it with the backoff widened further.
+type sendController struct {
+	mu      sync.Mutex
+	state   breakerState
+	backoff time.Duration
+	openTil time.Time
+}
+
+func newSendController() *sendController {
+	return &sendController{backoff: initialBackoff}
+}
+
+// allow reports whether a send to this peer should proceed right now.
+func (c *sendController) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Now().Before(c.openTil) {
+			return false
+		}
+		// Backoff window elapsed: allow a single probe through.
+		c.state = breakerHalfOpen
+		return true
+	default: // breakerHalfOpen
+		// A probe is already in flight; keep dropping until it resolves.
+		return false
+	}
+}
+
+// onSuccess closes the breaker and resets the backoff to its initial value.
+func (c *sendController) onSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = breakerClosed
+	c.backoff = initialBackoff
+}
+
+// onFailure widens the backoff (full jitter) and opens the breaker. It
+// reports whether this call is the one that transitioned the breaker from
+// closed to open, so the caller can call Raft().ReportUnreachable exactly
+// once per transition rather than once per failed send.
+func (c *sendController) onFailure() (transitioned bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	transitioned = c.state == breakerClosed
+	c.state = breakerOpen
+	c.openTil = time.Now().Add(time.Duration(rand.Int63n(int64(c.backoff) + 1)))
+	if c.backoff < maxBackoff {
+		c.backoff *= backoffMultiplier
+		if c.backoff > maxBackoff {
+			c.backoff = maxBackoff
+		}
+	}
+	return transitioned
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendControllerBackoffDoublesAndCaps(t *testing.T) {
+	c := newSendController()
+
+	want := initialBackoff
+	for i := 0; i < 20; i++ {
+		c.onFailure()
+		want *= backoffMultiplier
+		if want > maxBackoff {
+			want = maxBackoff
+		}
+		if c.backoff != want {
+			t.Fatalf("after %d failures: backoff = %v, want %v", i+1, c.backoff, want)
+		}
+	}
+	if c.backoff != maxBackoff {
+		t.Fatalf("backoff = %v after many failures, want capped at %v", c.backoff, maxBackoff)
+	}
+}
+
+func TestSendControllerHalfOpenAllowsExactlyOneProbe(t *testing.T) {
+	c := newSendController()
+	c.onFailure()
+	if c.state != breakerOpen {
+		t.Fatalf("state = %v after first failure, want breakerOpen", c.state)
+	}
+
+	// Pretend the backoff window has already elapsed.
+	c.openTil = time.Now().Add(-time.Millisecond)
+
+	if !c.allow() {
+		t.Fatalf("allow() = false on first call past the backoff window, want true (the probe)")
+	}
+	if c.state != breakerHalfOpen {
+		t.Fatalf("state = %v after the probe was let through, want breakerHalfOpen", c.state)
+	}
+	if c.allow() {
+		t.Fatalf("allow() = true while a probe is already in flight, want false")
+	}
+}
+
+func TestSendControllerSuccessResetsState(t *testing.T) {
+	c := newSendController()
+	c.onFailure()
+	c.onFailure()
+	if c.backoff == initialBackoff {
+		t.Fatalf("backoff did not widen after repeated failures")
+	}
+
+	c.onSuccess()
+	if c.state != breakerClosed {
+		t.Fatalf("state = %v after onSuccess, want breakerClosed", c.state)
+	}
+	if c.backoff != initialBackoff {
+		t.Fatalf("backoff = %v after onSuccess, want reset to %v", c.backoff, initialBackoff)
+	}
+	if !c.allow() {
+		t.Fatalf("allow() = false right after onSuccess, want true")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/x"
+	hraft "github.com/hashicorp/raft"
+	"golang.org/x/net/context"
+)
+
+// hashicorpRaftEngine adapts a hashicorp/raft.Raft instance to our RaftEngine
+// interface, so that a conn.Node can be driven by either Raft implementation
+// interchangeably. Unlike etcd/raft, hashicorp/raft does not expose a
+// channel-based Ready()/Advance() loop; it drives the FSM itself via Apply
+// and internal goroutines. We bridge the two models by feeding every applied
+// command into readyCh as a synthesized raft.Ready, so that the rest of
+// conn.Node (and worker's applyCh consumer) keeps working unmodified.
+type hashicorpRaftEngine struct {
+	r   *hraft.Raft
+	fsm *raftFSM
+
+	readyCh chan raft.Ready
+
+	closer sync.Once
+	stopCh chan struct{}
+}
+
+// NewHashicorpRaftEngine builds a RaftEngine backed by hashicorp/raft. store
+// and snaps back the log and snapshots respectively (typically backed by the
+// same raftwal.DiskStorage as the etcd/raft engine would use), and trans is
+// the transport used to dial other members of the group.
+func NewHashicorpRaftEngine(
+	rc *pb.RaftContext, store raftwalLogStore, snaps hraft.SnapshotStore,
+	trans hraft.Transport) (RaftEngine, error) {
+
+	fsm := &raftFSM{applyCh: make(chan hraft.Log, 100)}
+
+	cfg := hraft.DefaultConfig()
+	cfg.LocalID = hraft.ServerID(fmt.Sprintf("%#x", rc.Id))
+
+	r, err := hraft.NewRaft(cfg, fsm, store, store, snaps, trans)
+	if err != nil {
+		return nil, x.Errorf("while starting hashicorp/raft: %v", err)
+	}
+
+	e := &hashicorpRaftEngine{
+		r:       r,
+		fsm:     fsm,
+		readyCh: make(chan raft.Ready, 100),
+		stopCh:  make(chan struct{}),
+	}
+	go e.relayReady()
+	return e, nil
+}
+
+// relayReady translates FSM.Apply calls (driven internally by hashicorp/raft)
+// into raft.Ready values, so the rest of conn.Node can keep consuming
+// Ready()/Advance() the same way it does for the etcd/raft engine.
+func (e *hashicorpRaftEngine) relayReady() {
+	for {
+		select {
+		case <-e.stopCh:
+			return
+		case l := <-e.fsm.applyCh:
+			e.readyCh <- raft.Ready{
+				CommittedEntries: []raftpb.Entry{{
+					Index: l.Index,
+					Term:  l.Term,
+					Data:  l.Data,
+				}},
+			}
+		}
+	}
+}
+
+func (e *hashicorpRaftEngine) Propose(ctx context.Context, data []byte) error {
+	f := e.r.Apply(data, 10*time.Second)
+	return f.Error()
+}
+
+// ProposeConfChange translates a raftpb.ConfChange, the shape the rest of
+// conn.Node already knows how to build (see AddToCluster/AddLearnerToCluster),
+// into the equivalent hashicorp/raft membership call.
+func (e *hashicorpRaftEngine) ProposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	id := hraft.ServerID(fmt.Sprintf("%#x", cc.NodeID))
+	// cc.Context carries the peer's marshalled pb.RaftContext (empty for a
+	// removal), as AddToCluster/AddLearnerToCluster build it.
+	var rc pb.RaftContext
+	if err := rc.Unmarshal(cc.Context); err != nil {
+		return x.Errorf("while decoding conf change context: %v", err)
+	}
+	addr := hraft.ServerAddress(rc.Addr)
+
+	var f hraft.IndexFuture
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode:
+		f = e.r.AddVoter(id, addr, 0, 10*time.Second)
+	case raftpb.ConfChangeAddLearnerNode:
+		f = e.r.AddNonvoter(id, addr, 0, 10*time.Second)
+	case raftpb.ConfChangeRemoveNode:
+		f = e.r.RemoveServer(id, 0, 10*time.Second)
+	default:
+		return x.Errorf("unsupported conf change type for hashicorp engine: %v", cc.Type)
+	}
+	return f.Error()
+}
+
+func (e *hashicorpRaftEngine) Step(ctx context.Context, msg raftpb.Message) error {
+	// hashicorp/raft messages arrive through its own Transport, not via
+	// Step. Anything reaching here came in over our raftpb.Message-based
+	// wire format (e.g. from a peer still running the etcd engine), which
+	// the two engines can't interoperate on.
+	return x.Errorf("hashicorp raft engine does not accept raftpb.Message via Step")
+}
+
+func (e *hashicorpRaftEngine) Ready() <-chan raft.Ready {
+	return e.readyCh
+}
+
+func (e *hashicorpRaftEngine) Advance() {
+	// hashicorp/raft has already persisted and applied the entry by the
+	// time it shows up on readyCh, so there's nothing to acknowledge.
+}
+
+func (e *hashicorpRaftEngine) ReadIndex(ctx context.Context, rctx []byte) error {
+	if err := e.r.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *hashicorpRaftEngine) ReportUnreachable(id uint64) {
+	// hashicorp/raft's transport tracks reachability itself; nothing to do.
+}
+
+func (e *hashicorpRaftEngine) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	// hashicorp/raft's snapshot store tracks this itself; nothing to do.
+}
+
+// Status returns a best-effort RaftStatus. hashicorp/raft identifies the
+// leader by its ServerID (via LeaderWithID), so we recover the node ID by
+// parsing that back: it's the hex-encoded ID we assign every member, the same
+// way ProposeConfChange derives it. An unparseable or empty ServerID yields
+// a zero Lead.
+func (e *hashicorpRaftEngine) Status() RaftStatus {
+	_, id := e.r.LeaderWithID()
+	lead, err := strconv.ParseUint(string(id), 0, 64)
+	if err != nil {
+		return RaftStatus{}
+	}
+	return RaftStatus{Lead: lead}
+}
+
+// TransferLeadership asks hashicorp/raft to hand leadership off to a member of
+// its own choosing; lead and transferee are ignored, so the new leader is not
+// necessarily transferee.
+func (e *hashicorpRaftEngine) TransferLeadership(ctx context.Context, lead, transferee uint64) {
+	e.r.LeadershipTransfer()
+}
+
+func (e *hashicorpRaftEngine) Tick() {
+	// hashicorp/raft drives its own election/heartbeat timers internally;
+	// it has no equivalent of etcd/raft's externally-driven logical clock.
+}
+
+func (e *hashicorpRaftEngine) Stop() {
+	e.closer.Do(func() {
+		close(e.stopCh)
+		e.r.Shutdown()
+	})
+}
+
+// raftFSM implements hraft.FSM by forwarding every applied log entry onto
+// applyCh, which relayReady turns into raft.Ready values.
+type raftFSM struct {
+	applyCh chan hraft.Log
+}
+
+func (f *raftFSM) Apply(l *hraft.Log) interface{} {
+	f.applyCh <- *l
+	return nil
+}
+
+// Snapshot lets hashicorp/raft's own internal log compaction proceed. The
+// FSM has no state of its own beyond the applied log itself (the real,
+// application-level snapshot is Node.ExportSnapshot/ImportSnapshot), so
+// there's nothing for Persist to write; it only needs to succeed so
+// hashicorp/raft's snapshot cycle completes instead of failing permanently.
+// The log compaction hashicorp/raft then requests goes to
+// raftwalStore.DeleteRange, which removes nothing; entries are only reclaimed
+// by raftwal.DiskStorage's own snapshotting.
+func (f *raftFSM) Snapshot() (hraft.FSMSnapshot, error) {
+	return noopFSMSnapshot{}, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	return rc.Close()
+}
+
+type noopFSMSnapshot struct{}
+
+func (noopFSMSnapshot) Persist(sink hraft.SnapshotSink) error { return sink.Close() }
+
+func (noopFSMSnapshot) Release() {}
+
+// raftwalLogStore is the subset of raftwal.DiskStorage's API that
+// NewHashicorpRaftEngine needs in order to satisfy hraft.LogStore and
+// hraft.StableStore. It lets the hashicorp engine share the same on-disk log
+// that the etcd engine uses, modulo the different entry encoding. See
+// raftwalStore (hashicorp_storage.go) for the adapter that implements it.
+type raftwalLogStore interface {
+	hraft.LogStore
+	hraft.StableStore
+}
+
+// grpcTransport implements hraft.Transport on top of our existing gRPC
+// RaftMessage service (see conn.pool and pb.RaftClient), rather than
+// hashicorp/raft's usual TCP transport. The AppendEntries, RequestVote and
+// TimeoutNow RPCs are each wrapped in a raftTransportRPC envelope, JSON-encoded (sufficient for the small, infrequent control
+// messages these RPCs carry), and shipped as the payload of a pb.RaftBatch,
+// the same message our etcd/raft engine uses to move raftpb.Message bytes
+// around. This lets both engines share one gRPC service definition.
+// InstallSnapshot is not carried, and pipelined AppendEntries is not
+// supported; both return an error.
+type grpcTransport struct {
+	localAddr hraft.ServerAddress
+	rc        *pb.RaftContext
+
+	consumerCh chan hraft.RPC
+
+	mu          sync.Mutex
+	heartbeatFn func(hraft.RPC)
+}
+
+// raftTransportRPC is the self-describing envelope shipped over RaftMessage
+// for each hashicorp/raft RPC kind grpcTransport carries.
+type raftTransportRPC struct {
+	Kind string          `json:"kind"`
+	Body json.RawMessage `json:"body"`
+}
+
+// NewGRPCTransport builds an hraft.Transport that rides on the same
+// RaftMessage gRPC service our etcd/raft engine uses for raftpb.Message
+// traffic. rc identifies the local node for outgoing batches.
+func NewGRPCTransport(rc *pb.RaftContext) hraft.Transport {
+	return &grpcTransport{
+		localAddr:  hraft.ServerAddress(rc.Addr),
+		rc:         rc,
+		consumerCh: make(chan hraft.RPC),
+	}
+}
+
+func (t *grpcTransport) Consumer() <-chan hraft.RPC { return t.consumerCh }
+
+func (t *grpcTransport) LocalAddr() hraft.ServerAddress { return t.localAddr }
+
+func (t *grpcTransport) EncodePeer(id hraft.ServerID, addr hraft.ServerAddress) []byte {
+	return []byte(addr)
+}
+
+func (t *grpcTransport) DecodePeer(b []byte) hraft.ServerAddress {
+	return hraft.ServerAddress(b)
+}
+
+func (t *grpcTransport) SetHeartbeatHandler(cb func(rpc hraft.RPC)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.heartbeatFn = cb
+}
+
+// HandleRaftBatch is called by the RaftMessage gRPC handler (see worker's
+// grpc server) whenever an incoming batch's payload decodes as a
+// raftTransportRPC rather than a raftpb.Message. It decodes the envelope
+// into the concrete hashicorp/raft request type, hands it to whichever
+// hraft.Raft is reading Consumer() (that's what hraft.NewRaft registers
+// internally once started), and blocks until that RPC's RespChan answers or
+// ctx expires.
+func (t *grpcTransport) HandleRaftBatch(ctx context.Context, data []byte) (*api.Payload, error) {
+	var envelope raftTransportRPC
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, x.Errorf("grpcTransport: decoding RPC envelope: %v", err)
+	}
+
+	var cmd, resp interface{}
+	switch envelope.Kind {
+	case "AppendEntries":
+		var req hraft.AppendEntriesRequest
+		cmd, resp = &req, &hraft.AppendEntriesResponse{}
+	case "RequestVote":
+		var req hraft.RequestVoteRequest
+		cmd, resp = &req, &hraft.RequestVoteResponse{}
+	case "TimeoutNow":
+		var req hraft.TimeoutNowRequest
+		cmd, resp = &req, &hraft.TimeoutNowResponse{}
+	default:
+		return nil, x.Errorf("grpcTransport: unknown RPC kind %q", envelope.Kind)
+	}
+	if err := json.Unmarshal(envelope.Body, cmd); err != nil {
+		return nil, x.Errorf("grpcTransport: decoding %s request: %v", envelope.Kind, err)
+	}
+
+	respCh := make(chan hraft.RPCResponse, 1)
+	rpc := hraft.RPC{Command: cmd, RespChan: respCh}
+
+	select {
+	case t.consumerCh <- rpc:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case out := <-respCh:
+		if out.Error != nil {
+			return nil, out.Error
+		}
+		b, err := json.Marshal(out.Response)
+		if err != nil {
+			return nil, err
+		}
+		return &api.Payload{Data: b}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *grpcTransport) sendRPC(id hraft.ServerID, target hraft.ServerAddress, kind string, args interface{}, resp interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	envelope := raftTransportRPC{Kind: kind, Body: body}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	pool, err := Get().Get(string(target))
+	if err != nil {
+		return x.Errorf("while dialing hashicorp raft peer %s: %v", target, err)
+	}
+	c := pb.NewRaftClient(pool.Get())
+	batch := &pb.RaftBatch{
+		Context: t.rc,
+		Payload: &api.Payload{Data: payload},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := c.RaftMessage(ctx, batch)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out.Data, resp)
+}
+
+func (t *grpcTransport) AppendEntries(id hraft.ServerID, target hraft.ServerAddress,
+	args *hraft.AppendEntriesRequest, resp *hraft.AppendEntriesResponse) error {
+	return t.sendRPC(id, target, "AppendEntries", args, resp)
+}
+
+func (t *grpcTransport) AppendEntriesPipeline(id hraft.ServerID, target hraft.ServerAddress) (hraft.AppendPipeline, error) {
+	return nil, x.Errorf("pipelined AppendEntries is not supported over the grpcTransport")
+}
+
+func (t *grpcTransport) RequestVote(id hraft.ServerID, target hraft.ServerAddress,
+	args *hraft.RequestVoteRequest, resp *hraft.RequestVoteResponse) error {
+	return t.sendRPC(id, target, "RequestVote", args, resp)
+}
+
+func (t *grpcTransport) InstallSnapshot(id hraft.ServerID, target hraft.ServerAddress,
+	args *hraft.InstallSnapshotRequest, resp *hraft.InstallSnapshotResponse, data io.Reader) error {
+	// InstallSnapshot's payload is a stream, which doesn't fit the
+	// request/response RaftMessage RPC. Snapshot installation for the
+	// hashicorp engine instead goes through Node.ImportSnapshot.
+	return x.Errorf("InstallSnapshot over grpcTransport is not supported; use Node.ImportSnapshot")
+}
+
+func (t *grpcTransport) TimeoutNow(id hraft.ServerID, target hraft.ServerAddress,
+	args *hraft.TimeoutNowRequest, resp *hraft.TimeoutNowResponse) error {
+	return t.sendRPC(id, target, "TimeoutNow", args, resp)
+}
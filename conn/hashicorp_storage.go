@@ -0,0 +1,150 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sync"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/dgraph-io/dgraph/raftwal"
+	"github.com/dgraph-io/dgraph/x"
+	hraft "github.com/hashicorp/raft"
+)
+
+// keyCurrentTerm is the StableStore key hashicorp/raft itself writes (via
+// raft.go's setCurrentTerm) every time it advances its term. raftwalStore
+// watches for it so it can keep raftwal.DiskStorage's own HardState.Term in
+// sync instead of clobbering it with zero on every log write.
+var keyCurrentTerm = []byte("CurrentTerm")
+
+// raftwalStore adapts a raftwal.DiskStorage (shaped like etcd/raft's
+// Storage interface: an indexed raftpb.Entry log plus a single HardState)
+// into hraft.LogStore and hraft.StableStore, so NewHashicorpRaftEngine can
+// share the same on-disk log the etcd/raft engine uses instead of needing an
+// entirely separate storage engine. hashicorp/raft's hraft.Log values and
+// arbitrary key/value bookkeeping don't map onto raftwal's etcd/raft-shaped
+// API directly, so raftwalStore bridges the two: a hraft.Log is marshalled
+// into a raftpb.Entry's Data field (keeping Index/Term mirrored so raftwal's
+// own indexing still works), and StableStore keys are kept in memory, with
+// the one key hashicorp/raft relies on for correctness across restarts
+// (CurrentTerm) additionally folded into the HardState passed to every
+// Save call.
+type raftwalStore struct {
+	store *raftwal.DiskStorage
+
+	mu sync.Mutex
+	hs raftpb.HardState
+	kv map[string][]byte
+}
+
+// newRaftwalStore wraps store as a raftwalLogStore for NewHashicorpRaftEngine.
+func newRaftwalStore(store *raftwal.DiskStorage) *raftwalStore {
+	return &raftwalStore{store: store, kv: make(map[string][]byte)}
+}
+
+func (s *raftwalStore) FirstIndex() (uint64, error) { return s.store.FirstIndex() }
+func (s *raftwalStore) LastIndex() (uint64, error)  { return s.store.LastIndex() }
+
+func (s *raftwalStore) GetLog(index uint64, log *hraft.Log) error {
+	entries, err := s.store.Entries(index, index+1, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return hraft.ErrLogNotFound
+	}
+	return json.Unmarshal(entries[0].Data, log)
+}
+
+func (s *raftwalStore) StoreLog(log *hraft.Log) error {
+	return s.StoreLogs([]*hraft.Log{log})
+}
+
+func (s *raftwalStore) StoreLogs(logs []*hraft.Log) error {
+	entries := make([]raftpb.Entry, len(logs))
+	for i, l := range logs {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		entries[i] = raftpb.Entry{Index: l.Index, Term: l.Term, Data: data}
+	}
+
+	s.mu.Lock()
+	hs := s.hs
+	s.mu.Unlock()
+	return s.store.Save(hs, entries, raftpb.Snapshot{})
+}
+
+func (s *raftwalStore) DeleteRange(min, max uint64) error {
+	// hashicorp/raft only calls this to trim log entries it has already
+	// compacted away via FSM.Snapshot (a no-op for us; see raftFSM.Snapshot
+	// in hashicorp_raft.go). raftwal.DiskStorage reclaims old entries through
+	// its own snapshotting instead of an explicit delete-range, so there's
+	// nothing to do here.
+	return nil
+}
+
+func (s *raftwalStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *raftwalStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kv[string(key)], nil
+}
+
+func (s *raftwalStore) SetUint64(key []byte, val uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[string(key)] = b[:]
+	if string(key) == string(keyCurrentTerm) {
+		s.hs.Term = val
+	}
+	return nil
+}
+
+func (s *raftwalStore) GetUint64(key []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.kv[string(key)]
+	if !ok {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+var _ raftwalLogStore = (*raftwalStore)(nil)
+
+// NewRaftwalLogStore adapts store to the hraft.LogStore/hraft.StableStore
+// shape NewHashicorpRaftEngine needs, so callers constructing a hashicorp
+// engine can hand it the same raftwal.DiskStorage the etcd engine would use
+// for this group, rather than standing up a second storage engine.
+func NewRaftwalLogStore(store *raftwal.DiskStorage) *raftwalStore {
+	x.AssertTrue(store != nil)
+	return newRaftwalStore(store)
+}
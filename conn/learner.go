@@ -0,0 +1,253 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/x"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Role describes whether a peer participates in the Raft quorum (Voter) or is
+// only catching up on the log (Learner).
+type Role int
+
+const (
+	RoleVoter Role = iota
+	RoleLearner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleVoter:
+		return "Voter"
+	case RoleLearner:
+		return "Learner"
+	default:
+		return "Unknown"
+	}
+}
+
+// peerInfo is what Node.peers stores per peer: its address, for dialing, and
+// its last known role, for the learner-promotion reconciler below.
+type peerInfo struct {
+	Addr string
+	Role Role
+}
+
+// DefaultLearnerPromoteLagThreshold is the Node.LearnerPromoteLagThreshold
+// NewNode sets by default: how close (in log entries) a learner's Applied
+// watermark must be to the leader's own Applied watermark before it's
+// considered caught up. The leader's committed index is not consulted, so
+// entries the leader has committed but not yet applied do not count toward
+// the lag. Callers that know their workload's
+// write rate can override Node.LearnerPromoteLagThreshold after construction
+// to promote more or less eagerly.
+const DefaultLearnerPromoteLagThreshold = 100
+
+const (
+	// learnerPromoteSustainFor is how long a learner must stay under
+	// Node.LearnerPromoteLagThreshold before AddLearnerToCluster promotes it.
+	// This avoids promoting on a single lucky poll while the learner is still
+	// bursting through old entries.
+	learnerPromoteSustainFor = 5 * time.Second
+	learnerPollInterval      = 500 * time.Millisecond
+)
+
+// learnerReconciler is the learnerReconcilers map entry for one pid: a
+// handle unique to the goroutine startLearnerReconciler started for it, so
+// that goroutine's own cleanup can tell whether it's still the current
+// entry (as opposed to having been superseded by a later start) before
+// deleting it.
+type learnerReconciler struct {
+	cancel context.CancelFunc
+}
+
+// AddLearnerToCluster adds pid to the cluster as a non-voting learner, then
+// starts a background reconciler which polls the learner's progress until it
+// has caught up enough with the leader's log to be safely promoted to a full
+// voter, at which point the reconciler issues the follow-up ConfChangeAddNode
+// itself. Unlike AddToCluster, this never leaves the quorum transiently
+// reduced: pid only starts voting once it's known to be caught up.
+//
+// AddLearnerToCluster returns as soon as the learner conf change is accepted,
+// without waiting for catch-up; catch-up can take far longer than any
+// caller's RPC-scoped ctx would tolerate. Use DeletePeer to cancel a
+// reconciler for a peer that's been removed before it caught up.
+func (n *Node) AddLearnerToCluster(ctx context.Context, pid uint64) error {
+	addr, ok := n.Peer(pid)
+	x.AssertTruef(ok, "Unable to find conn pool for peer: %#x", pid)
+	rc := &pb.RaftContext{
+		Addr:      addr,
+		Group:     n.RaftContext.Group,
+		Id:        pid,
+		IsLearner: true,
+	}
+	rcBytes, err := rc.Marshal()
+	x.Check(err)
+
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  pid,
+		Context: rcBytes,
+	}
+	err = errInternalRetry
+	for err == errInternalRetry {
+		glog.Infof("Trying to add %#x to cluster as a learner. Addr: %v\n", pid, addr)
+		err = n.proposeConfChange(ctx, cc)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.startLearnerReconciler(pid)
+	return nil
+}
+
+// startLearnerReconciler launches (or replaces) the background goroutine
+// that waits for pid to catch up and then promotes it to a voter. It's
+// cancelled, instead of the RPC-scoped ctx that requested the learner be
+// added, so catch-up keeps being tracked long after that RPC has returned.
+func (n *Node) startLearnerReconciler(pid uint64) {
+	rctx, cancel := context.WithCancel(context.Background())
+	r := &learnerReconciler{cancel: cancel}
+
+	n.Lock()
+	if prev, ok := n.learnerReconcilers[pid]; ok {
+		prev.cancel()
+	}
+	n.learnerReconcilers[pid] = r
+	n.Unlock()
+
+	n.reconcilerWg.Add(1)
+	go func() {
+		defer n.reconcilerWg.Done()
+		defer func() {
+			// Only clean up the map entry if it's still the one we were
+			// started with: if a later AddLearnerToCluster call for this
+			// same pid has already replaced it, that newer goroutine's own
+			// cleanup owns deleting it, not us (else we'd delete the new
+			// reconciler's tracking out from under it, leaving it running
+			// but unreachable from DeletePeer).
+			n.Lock()
+			if n.learnerReconcilers[pid] == r {
+				delete(n.learnerReconcilers, pid)
+			}
+			n.Unlock()
+			cancel()
+		}()
+
+		if err := n.waitForLearnerCatchUp(rctx, pid); err != nil {
+			glog.Warningf("Learner %#x did not catch up, won't promote: %v\n", pid, err)
+			return
+		}
+		if err := n.AddToCluster(rctx, pid); err != nil {
+			glog.Warningf("While promoting caught-up learner %#x to voter: %v\n", pid, err)
+		}
+	}()
+}
+
+// waitForLearnerCatchUp polls pid's Progress RPC until its Applied watermark
+// has stayed within Node.LearnerPromoteLagThreshold of our own Applied
+// watermark (see learnerLag) for learnerPromoteSustainFor.
+func (n *Node) waitForLearnerCatchUp(ctx context.Context, pid uint64) error {
+	var caughtUpSince time.Time
+	ticker := time.NewTicker(learnerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			lag, err := n.learnerLag(ctx, pid)
+			if err != nil {
+				glog.Warningf("While checking learner %#x progress: %v\n", pid, err)
+				caughtUpSince = time.Time{}
+				continue
+			}
+			if lag > n.LearnerPromoteLagThreshold {
+				caughtUpSince = time.Time{}
+				continue
+			}
+			if caughtUpSince.IsZero() {
+				caughtUpSince = time.Now()
+				continue
+			}
+			if time.Since(caughtUpSince) >= learnerPromoteSustainFor {
+				glog.Infof("Learner %#x has caught up (lag %d); promoting to voter\n", pid, lag)
+				return nil
+			}
+		}
+	}
+}
+
+// learnerLag asks pid, over the Raft service's Progress RPC, how far its
+// applied index lags our own Applied watermark. Our committed index is not
+// consulted: entries we have committed but not yet applied are not counted.
+func (n *Node) learnerLag(ctx context.Context, pid uint64) (uint64, error) {
+	addr, ok := n.Peer(pid)
+	if !ok {
+		return 0, x.Errorf("no address known for peer %#x", pid)
+	}
+	pool, err := Get().Get(addr)
+	if err != nil {
+		return 0, err
+	}
+	c := pb.NewRaftClient(pool.Get())
+
+	cctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	req := &pb.ProgressRequest{Group: n.RaftContext.Group, Id: pid}
+	resp, err := c.Progress(cctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	lead := n.Raft().Status().Lead
+	if lead != n.Id {
+		// We're not the leader, so we have no authoritative committed index
+		// to compare pid's progress against. Error out (and let the caller
+		// treat this the same as any other failed poll) rather than
+		// reporting a fake zero lag, which would let a learner get promoted
+		// to voter without ever actually being checked.
+		return 0, x.Errorf(
+			"not the leader (lead=%#x); can't judge learner %#x's catch-up", lead, pid)
+	}
+	committed := n.Applied.DoneUntil()
+	if resp.AppliedIndex >= committed {
+		return 0, nil
+	}
+	return committed - resp.AppliedIndex, nil
+}
+
+// Progress answers the pb.RaftServer Progress RPC (implemented by the
+// worker package's gRPC server), reporting how far this node's applied Raft
+// log has advanced. A leader's learner-promotion reconciler (see learnerLag
+// above) polls this on the learner to decide when it's safe to promote.
+func (n *Node) Progress() *pb.ProgressResponse {
+	snap, err := n.Store.Snapshot()
+	x.Check(err)
+	return &pb.ProgressResponse{
+		AppliedIndex:  n.Applied.DoneUntil(),
+		SnapshotIndex: snap.Metadata.Index,
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStartLearnerReconcilerSupersedeDoesNotLoseTracking guards against a
+// cleanup race: when a second startLearnerReconciler call for the same pid
+// replaces an in-flight reconciler, the superseded goroutine's own cleanup
+// must not delete the new reconciler's map entry out from under it (it
+// would still be running, but DeletePeer could no longer cancel it).
+func TestStartLearnerReconcilerSupersedeDoesNotLoseTracking(t *testing.T) {
+	n := &Node{learnerReconcilers: make(map[uint64]*learnerReconciler)}
+
+	const pid = 7
+	n.startLearnerReconciler(pid)
+	n.startLearnerReconciler(pid)
+
+	n.RLock()
+	second := n.learnerReconcilers[pid]
+	n.RUnlock()
+	if second == nil {
+		t.Fatalf("learnerReconcilers[%d] is nil right after the second start", pid)
+	}
+
+	// Give the first (now-cancelled) goroutine's deferred cleanup a chance
+	// to run; it should see it's no longer the current entry and leave the
+	// second one alone.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n.RLock()
+		cur := n.learnerReconcilers[pid]
+		n.RUnlock()
+		if cur != second {
+			t.Fatalf("learnerReconcilers[%d] changed to %v, want the second reconciler untouched", pid, cur)
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Clean up: cancel the still-running second reconciler and wait for it.
+	second.cancel()
+	done := make(chan struct{})
+	go func() {
+		n.reconcilerWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconciler goroutines did not exit after cancellation")
+	}
+}
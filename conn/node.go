@@ -47,24 +47,53 @@ type Node struct {
 
 	joinLock sync.Mutex
 
+	// reconcilerWg lets Node shutdown wait for any in-flight learner
+	// reconcilers (see learnerReconcilers) to exit.
+	reconcilerWg sync.WaitGroup
+
 	// Used to keep track of lin read requests.
 	requestCh chan linReadReq
 
 	// SafeMutex is for fields which can be changed after init.
 	_confState *raftpb.ConfState
-	_raft      raft.Node
+	_raft      RaftEngine
+
+	// learnerReconcilers tracks the background goroutines AddLearnerToCluster
+	// starts to wait for a learner to catch up and then promote it, keyed by
+	// peer ID, so DeletePeer can cancel a stale one and the reconciler has a
+	// lifecycle independent of whatever RPC-scoped ctx called
+	// AddLearnerToCluster. Each entry is a pointer unique to the goroutine it
+	// was started for, so a goroutine's own cleanup can tell whether it's
+	// still the current entry for pid before deleting it (a superseding
+	// start replaces the pointer, not just the cancel func it holds).
+	// Guarded by SafeMutex like the other "changed after init" fields above.
+	learnerReconcilers map[uint64]*learnerReconciler
 
 	// Fields which are never changed after init.
 	Cfg         *raft.Config
 	MyAddr      string
 	Id          uint64
-	peers       map[uint64]string
+	peers       map[uint64]peerInfo
 	confChanges map[uint64]chan error
 	messages    chan sendmsg
 	RaftContext *pb.RaftContext
 	Store       *raftwal.DiskStorage
 	Rand        *rand.Rand
 
+	// Engine records which RaftEngine implementation this Node was
+	// configured to run (see EngineEtcd, EngineHashicorp). It's up to the
+	// caller to construct the matching engine and pass it to SetRaft; Node
+	// itself only talks to the RaftEngine interface from here on.
+	Engine string
+
+	// LearnerPromoteLagThreshold is how close (in log entries) a learner's
+	// Applied watermark must be to the leader's own Applied watermark (not
+	// its committed index) before AddLearnerToCluster's reconciler considers
+	// it caught up and promotes it to a voter. NewNode sets this to
+	// DefaultLearnerPromoteLagThreshold; callers that know their workload's
+	// write rate can tighten or loosen it afterwards.
+	LearnerPromoteLagThreshold uint64
+
 	Proposals proposals
 	// applied is used to keep track of the applied RAFT proposals.
 	// The stages are proposed -> committed (accepted by cluster) ->
@@ -88,14 +117,24 @@ func (rl *ToGlog) Fatalf(format string, v ...interface{})   { glog.Fatalf(format
 func (rl *ToGlog) Panic(v ...interface{})                   { log.Panic(v...) }
 func (rl *ToGlog) Panicf(format string, v ...interface{})   { log.Panicf(format, v...) }
 
-func NewNode(rc *pb.RaftContext, store *raftwal.DiskStorage) *Node {
+// NewNode creates a Node for the given RaftContext and storage. engine picks
+// which RaftEngine implementation (EngineEtcd or EngineHashicorp) the caller
+// is expected to construct and install via SetRaft; Node itself remains
+// agnostic to the choice once that's done. An empty engine defaults to
+// EngineEtcd, Dgraph's long-standing implementation.
+func NewNode(rc *pb.RaftContext, store *raftwal.DiskStorage, engine string) *Node {
 	snap, err := store.Snapshot()
 	x.Check(err)
 
+	if engine == "" {
+		engine = EngineEtcd
+	}
+
 	n := &Node{
 		Id:     rc.Id,
 		MyAddr: rc.Addr,
 		Store:  store,
+		Engine: engine,
 		Cfg: &raft.Config{
 			ID:              rc.Id,
 			ElectionTick:    100, // 2s if we call Tick() every 20 ms.
@@ -137,13 +176,15 @@ func NewNode(rc *pb.RaftContext, store *raftwal.DiskStorage) *Node {
 		},
 		// processConfChange etc are not throttled so some extra delta, so that we don't
 		// block tick when applyCh is full
-		Applied:     y.WaterMark{Name: fmt.Sprintf("Applied watermark")},
-		RaftContext: rc,
-		Rand:        rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())}),
-		confChanges: make(map[uint64]chan error),
-		messages:    make(chan sendmsg, 100),
-		peers:       make(map[uint64]string),
-		requestCh:   make(chan linReadReq),
+		Applied:                    y.WaterMark{Name: fmt.Sprintf("Applied watermark")},
+		RaftContext:                rc,
+		Rand:                       rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())}),
+		confChanges:                make(map[uint64]chan error),
+		messages:                   make(chan sendmsg, 100),
+		peers:                      make(map[uint64]peerInfo),
+		requestCh:                  make(chan linReadReq),
+		learnerReconcilers:         make(map[uint64]*learnerReconciler),
+		LearnerPromoteLagThreshold: DefaultLearnerPromoteLagThreshold,
 	}
 	n.Applied.Init()
 	// This should match up to the Applied index set above.
@@ -152,28 +193,33 @@ func NewNode(rc *pb.RaftContext, store *raftwal.DiskStorage) *Node {
 	return n
 }
 
-// SetRaft would set the provided raft.Node to this node.
+// SetRaft would set the provided RaftEngine to this node.
 // It would check fail if the node is already set.
-func (n *Node) SetRaft(r raft.Node) {
+func (n *Node) SetRaft(r RaftEngine) {
 	n.Lock()
 	defer n.Unlock()
 	x.AssertTrue(n._raft == nil)
 	n._raft = r
 }
 
-// Raft would return back the raft.Node stored in the node.
-func (n *Node) Raft() raft.Node {
+// Raft would return back the RaftEngine stored in the node.
+func (n *Node) Raft() RaftEngine {
 	n.RLock()
 	defer n.RUnlock()
 	return n._raft
 }
 
-// SetConfState would store the latest ConfState generated by ApplyConfChange.
-func (n *Node) SetConfState(cs *raftpb.ConfState) {
-	glog.Infof("Setting conf state to %+v\n", cs)
+// Stop shuts down this Node's RaftEngine, cancels any in-flight learner
+// reconcilers (see learnerReconcilers) and waits for them to exit, so that
+// neither outlives the Node itself.
+func (n *Node) Stop() {
+	n.Raft().Stop()
 	n.Lock()
-	defer n.Unlock()
-	n._confState = cs
+	for _, r := range n.learnerReconcilers {
+		r.cancel()
+	}
+	n.Unlock()
+	n.reconcilerWg.Wait()
 }
 
 func (n *Node) DoneConfChange(id uint64, err error) {
@@ -207,19 +253,57 @@ func (n *Node) ConfState() *raftpb.ConfState {
 	return n._confState
 }
 
+// SetConfState would store the latest ConfState generated by ApplyConfChange,
+// and reconciles n.peers' roles against it: any peer listed under cs.Nodes is
+// a Voter, any peer listed under cs.Learners is a Learner. This is how a
+// learner's role in n.peers flips back to Voter once AddLearnerToCluster's
+// reconciler promotes it (see learner.go).
+func (n *Node) SetConfState(cs *raftpb.ConfState) {
+	glog.Infof("Setting conf state to %+v\n", cs)
+	n.Lock()
+	defer n.Unlock()
+	n._confState = cs
+	for _, id := range cs.Nodes {
+		if p, ok := n.peers[id]; ok {
+			p.Role = RoleVoter
+			n.peers[id] = p
+		}
+	}
+	for _, id := range cs.Learners {
+		if p, ok := n.peers[id]; ok {
+			p.Role = RoleLearner
+			n.peers[id] = p
+		}
+	}
+}
+
 func (n *Node) Peer(pid uint64) (string, bool) {
 	n.RLock()
 	defer n.RUnlock()
-	addr, ok := n.peers[pid]
-	return addr, ok
+	p, ok := n.peers[pid]
+	return p.Addr, ok
 }
 
-// addr must not be empty.
+// PeerRole returns the last known role (Voter or Learner) for pid.
+func (n *Node) PeerRole(pid uint64) (Role, bool) {
+	n.RLock()
+	defer n.RUnlock()
+	p, ok := n.peers[pid]
+	return p.Role, ok
+}
+
+// addr must not be empty. New peers default to RoleVoter; use
+// AddLearnerToCluster to bring a peer in as a learner instead.
 func (n *Node) SetPeer(pid uint64, addr string) {
 	x.AssertTruef(addr != "", "SetPeer for peer %d has empty addr.", pid)
 	n.Lock()
 	defer n.Unlock()
-	n.peers[pid] = addr
+	p, ok := n.peers[pid]
+	p.Addr = addr
+	if !ok {
+		p.Role = RoleVoter
+	}
+	n.peers[pid] = p
 }
 
 func (n *Node) Send(m raftpb.Message) {
@@ -304,24 +388,45 @@ const (
 	messageBatchSoftLimit = 10000000
 )
 
+// controllerFor returns the sendController tracking backoff/circuit-breaker
+// state for sends to peer to, creating one the first time it's needed.
+func (n *Node) controllerFor(to uint64, controllers map[uint64]*sendController) *sendController {
+	c, ok := controllers[to]
+	if !ok {
+		c = newSendController()
+		controllers[to] = c
+	}
+	return c
+}
+
 func (n *Node) BatchAndSendMessages() {
 	batches := make(map[uint64]*bytes.Buffer)
 	failedConn := make(map[uint64]bool)
+	controllers := make(map[uint64]*sendController)
 	for {
 		totalSize := 0
 		sm := <-n.messages
 	slurp_loop:
 		for {
-			var buf *bytes.Buffer
-			if b, ok := batches[sm.to]; !ok {
-				buf = new(bytes.Buffer)
-				batches[sm.to] = buf
+			if !n.controllerFor(sm.to, controllers).allow() {
+				// The circuit breaker for this peer is open: drop the
+				// message instead of letting it pile up in the batch. A
+				// dropped MsgSnap still needs to be reported as failed, so
+				// Raft doesn't wait forever for a snapshot that's never
+				// coming.
+				n.reportDroppedMessage(sm)
 			} else {
-				buf = b
+				var buf *bytes.Buffer
+				if b, ok := batches[sm.to]; !ok {
+					buf = new(bytes.Buffer)
+					batches[sm.to] = buf
+				} else {
+					buf = b
+				}
+				totalSize += 4 + len(sm.data)
+				x.Check(binary.Write(buf, binary.LittleEndian, uint32(len(sm.data))))
+				x.Check2(buf.Write(sm.data))
 			}
-			totalSize += 4 + len(sm.data)
-			x.Check(binary.Write(buf, binary.LittleEndian, uint32(len(sm.data))))
-			x.Check2(buf.Write(sm.data))
 
 			if totalSize > messageBatchSoftLimit {
 				// We limit the batch size, but we aren't pushing back on
@@ -359,13 +464,27 @@ func (n *Node) BatchAndSendMessages() {
 			failedConn[to] = false
 			data := make([]byte, buf.Len())
 			copy(data, buf.Bytes())
-			go n.doSendMessage(to, pool, data)
+			go n.doSendMessage(to, pool, data, n.controllerFor(to, controllers))
 			buf.Reset()
 		}
 	}
 }
 
-func (n *Node) doSendMessage(to uint64, pool *Pool, data []byte) {
+// reportDroppedMessage tells Raft about a message BatchAndSendMessages chose
+// not to send because the destination's circuit breaker is open. A dropped
+// MsgSnap is reported as a failed snapshot so Raft retries it later instead
+// of waiting on one that was silently thrown away.
+func (n *Node) reportDroppedMessage(sm sendmsg) {
+	var msg raftpb.Message
+	if err := msg.Unmarshal(sm.data); err != nil {
+		return
+	}
+	if msg.Type == raftpb.MsgSnap {
+		n.Raft().ReportSnapshot(sm.to, raft.SnapshotFailure)
+	}
+}
+
+func (n *Node) doSendMessage(to uint64, pool *Pool, data []byte, ctrl *sendController) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -382,16 +501,21 @@ func (n *Node) doSendMessage(to uint64, pool *Pool, data []byte) {
 	// already being run in one.
 	_, err := c.RaftMessage(ctx, batch)
 	if err != nil {
+		transitioned := ctrl.onFailure()
 		switch {
 		case strings.Contains(err.Error(), "TransientFailure"):
-			glog.Warningf("Reporting node: %d addr: %s as unreachable.", to, pool.Addr)
-			n.Raft().ReportUnreachable(to)
 			pool.SetUnhealthy()
 		default:
 			glog.V(3).Infof("Error while sending Raft message to node with addr: %s, err: %v\n",
 				pool.Addr, err)
 		}
+		if transitioned {
+			glog.Warningf("Reporting node: %d addr: %s as unreachable.", to, pool.Addr)
+			n.Raft().ReportUnreachable(to)
+		}
+		return
 	}
+	ctrl.onSuccess()
 	// We don't need to do anything if we receive any error while sending message.
 	// RAFT would automatically retry.
 	return
@@ -428,6 +552,10 @@ func (n *Node) DeletePeer(pid uint64) {
 	n.Lock()
 	defer n.Unlock()
 	delete(n.peers, pid)
+	if r, ok := n.learnerReconcilers[pid]; ok {
+		r.cancel()
+		delete(n.learnerReconcilers, pid)
+	}
 }
 
 var errInternalRetry = errors.New("Retry proposal again")
@@ -527,38 +655,49 @@ func (n *Node) WaitLinearizableRead(ctx context.Context) error {
 	}
 }
 
-func (n *Node) RunReadIndexLoop(closer *y.Closer, readStateCh <-chan raft.ReadState) {
-	defer closer.Done()
-	readIndex := func() (uint64, error) {
-		// Read Request can get rejected then we would wait idefinitely on the channel
-		// so have a timeout.
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-
-		var activeRctx [8]byte
-		x.Check2(n.Rand.Read(activeRctx[:]))
-		if err := n.Raft().ReadIndex(ctx, activeRctx[:]); err != nil {
-			glog.Errorf("Error while trying to call ReadIndex: %v\n", err)
-			return 0, err
-		}
+// readIndexRound issues a single ReadIndex call, keyed by a fresh random
+// activeRctx, and waits for the matching ReadState to come back on
+// readStateCh. While it waits, it keeps draining n.requestCh into requests,
+// so that any WaitLinearizableRead callers who show up mid-round are served
+// by this same round's index instead of having to wait for the next one.
+func (n *Node) readIndexRound(
+	closer *y.Closer, readStateCh <-chan raft.ReadState, requests *[]linReadReq) (uint64, error) {
+
+	// Read Request can get rejected then we would wait idefinitely on the channel
+	// so have a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var activeRctx [8]byte
+	x.Check2(n.Rand.Read(activeRctx[:]))
+	if err := n.Raft().ReadIndex(ctx, activeRctx[:]); err != nil {
+		glog.Errorf("Error while trying to call ReadIndex: %v\n", err)
+		return 0, err
+	}
 
-	again:
+	for {
 		select {
 		case <-closer.HasBeenClosed():
 			return 0, errors.New("Closer has been called")
 		case rs := <-readStateCh:
 			if !bytes.Equal(activeRctx[:], rs.RequestCtx) {
-				goto again
+				continue
 			}
 			return rs.Index, nil
+		case req := <-n.requestCh:
+			*requests = append(*requests, req)
 		case <-ctx.Done():
 			glog.Warningf("[%#x] Read index context timed out\n", n.Id)
 			return 0, errInternalRetry
 		}
-	} // end of readIndex func
+	}
+}
+
+func (n *Node) RunReadIndexLoop(closer *y.Closer, readStateCh <-chan raft.ReadState) {
+	defer closer.Done()
 
 	// We maintain one linearizable ReadIndex request at a time.  Others wait queued behind
-	// requestCh.
+	// requestCh, and are folded into the in-flight round by readIndexRound.
 	requests := []linReadReq{}
 	for {
 		select {
@@ -568,17 +707,18 @@ func (n *Node) RunReadIndexLoop(closer *y.Closer, readStateCh <-chan raft.ReadSt
 			// Do nothing, discard ReadState as we don't have any pending ReadIndex requests.
 			glog.Warningf("Received a read state unexpectedly: %+v\n", rs)
 		case req := <-n.requestCh:
+			requests = append(requests, req)
 		slurpLoop:
 			for {
-				requests = append(requests, req)
 				select {
 				case req = <-n.requestCh:
+					requests = append(requests, req)
 				default:
 					break slurpLoop
 				}
 			}
 			for {
-				index, err := readIndex()
+				index, err := n.readIndexRound(closer, readStateCh, &requests)
 				if err == errInternalRetry {
 					continue
 				}
@@ -595,3 +735,38 @@ func (n *Node) RunReadIndexLoop(closer *y.Closer, readStateCh <-chan raft.ReadSt
 		}
 	}
 }
+
+// WaitLinearizableReadOnFollower lets any replica, not just the leader,
+// serve a linearizable read. It asks the current leader (as known via
+// Raft().Status().Lead and Node.Peer) to run its normal ReadIndex path via a
+// lightweight GetReadIndex RPC, and once the leader reports back the
+// committed index, blocks on this node's own Applied watermark catching up
+// to it. If this node is itself the leader, it just falls back to
+// WaitLinearizableRead.
+func (n *Node) WaitLinearizableReadOnFollower(ctx context.Context) error {
+	lead := n.Raft().Status().Lead
+	if lead == 0 {
+		return errReadIndex
+	}
+	if lead == n.Id {
+		return n.WaitLinearizableRead(ctx)
+	}
+
+	addr, ok := n.Peer(lead)
+	if !ok {
+		return x.Errorf("WaitLinearizableReadOnFollower: no address known for leader %#x", lead)
+	}
+	pool, err := Get().Get(addr)
+	if err != nil {
+		return err
+	}
+	c := pb.NewRaftClient(pool.Get())
+
+	cctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	resp, err := c.GetReadIndex(cctx, &pb.RaftContext{Group: n.RaftContext.Group, Id: n.Id})
+	if err != nil {
+		return err
+	}
+	return n.Applied.WaitForMark(ctx, resp.Index)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"golang.org/x/net/context"
+)
+
+// EngineEtcd and EngineHashicorp are the values accepted by NewNode's engine
+// flag to pick the RaftEngine implementation a Node should be backed by.
+const (
+	EngineEtcd      = "etcd"
+	EngineHashicorp = "hashicorp"
+)
+
+// RaftEngine abstracts over the concrete Raft implementation backing a Node.
+// It is deliberately shaped like github.com/coreos/etcd/raft.Node, since that
+// is the implementation Dgraph has always used, and the interface lets us
+// swap in alternatives (e.g. hashicorp/raft, see hashicorp_raft.go) without
+// touching the rest of conn.Node. Callers should go through Node.Raft() and
+// never type-assert back to a concrete implementation.
+type RaftEngine interface {
+	// Propose proposes data be appended to the log.
+	Propose(ctx context.Context, data []byte) error
+	// ProposeConfChange proposes a config change.
+	ProposeConfChange(ctx context.Context, cc raftpb.ConfChange) error
+	// Step advances the state machine using the given message.
+	Step(ctx context.Context, msg raftpb.Message) error
+	// Ready returns a channel that returns the current point-in-time state.
+	Ready() <-chan raft.Ready
+	// Advance notifies the engine that the application has applied and saved
+	// progress up to the last Ready it fetched.
+	Advance()
+	// ReadIndex requests a read state; the resulting ReadState is delivered
+	// through a later Ready.ReadStates, tagged with the given rctx.
+	ReadIndex(ctx context.Context, rctx []byte) error
+	// ReportUnreachable reports that the given peer is not reachable.
+	ReportUnreachable(id uint64)
+	// ReportSnapshot reports the status of a sent snapshot.
+	ReportSnapshot(id uint64, status raft.SnapshotStatus)
+	// Status returns the current status of this engine.
+	Status() RaftStatus
+	// TransferLeadership attempts to transfer leadership to the given node.
+	TransferLeadership(ctx context.Context, lead, transferee uint64)
+	// Tick increments the internal logical clock, which drives elections and
+	// heartbeats.
+	Tick()
+	// Stop performs any necessary termination of the engine.
+	Stop()
+}
+
+// RaftStatus is the subset of an engine's status that the rest of conn.Node
+// relies on. etcd/raft's raft.Status carries a lot more (term, progress
+// tracking per-peer, etc.) that's specific to its own internals and has no
+// clean equivalent in hashicorp/raft, so RaftEngine only promises this much.
+type RaftStatus struct {
+	// Lead is the ID of the node this engine believes is the current leader,
+	// or zero if unknown.
+	Lead uint64
+}
+
+// etcdRaftEngine adapts an *etcd/raft.Node, the implementation Dgraph has
+// always used, to the RaftEngine interface. It is a thin, behavior-preserving
+// wrapper: every call is forwarded as-is.
+type etcdRaftEngine struct {
+	r raft.Node
+}
+
+// NewEtcdRaftEngine wraps r, an etcd/raft.Node, as a RaftEngine.
+func NewEtcdRaftEngine(r raft.Node) RaftEngine {
+	return &etcdRaftEngine{r: r}
+}
+
+func (e *etcdRaftEngine) Propose(ctx context.Context, data []byte) error {
+	return e.r.Propose(ctx, data)
+}
+
+func (e *etcdRaftEngine) ProposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	return e.r.ProposeConfChange(ctx, cc)
+}
+
+func (e *etcdRaftEngine) Step(ctx context.Context, msg raftpb.Message) error {
+	return e.r.Step(ctx, msg)
+}
+
+func (e *etcdRaftEngine) Ready() <-chan raft.Ready {
+	return e.r.Ready()
+}
+
+func (e *etcdRaftEngine) Advance() {
+	e.r.Advance()
+}
+
+func (e *etcdRaftEngine) ReadIndex(ctx context.Context, rctx []byte) error {
+	return e.r.ReadIndex(ctx, rctx)
+}
+
+func (e *etcdRaftEngine) ReportUnreachable(id uint64) {
+	e.r.ReportUnreachable(id)
+}
+
+func (e *etcdRaftEngine) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	e.r.ReportSnapshot(id, status)
+}
+
+func (e *etcdRaftEngine) Status() RaftStatus {
+	return RaftStatus{Lead: e.r.Status().Lead}
+}
+
+func (e *etcdRaftEngine) TransferLeadership(ctx context.Context, lead, transferee uint64) {
+	e.r.TransferLeadership(ctx, lead, transferee)
+}
+
+func (e *etcdRaftEngine) Tick() {
+	e.r.Tick()
+}
+
+func (e *etcdRaftEngine) Stop() {
+	e.r.Stop()
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// logicalSnapshotVersion is bumped whenever the framing or meaning of
+// pb.LogicalSnapshot's fields changes, so ImportSnapshot can refuse a
+// snapshot it doesn't know how to interpret instead of silently
+// misreading it.
+const logicalSnapshotVersion = 1
+
+// SnapshotDataSource supplies the opaque schema and posting-list payloads
+// that make up a logical snapshot. conn.Node knows how to frame and
+// transport these across a cluster boundary (see ExportSnapshot/
+// ImportSnapshot below), but has no notion of schema or posting lists
+// itself; the worker package registers the real implementation here at
+// startup.
+type SnapshotDataSource interface {
+	// ExportData returns the schema and posting-list payloads for group, to
+	// be embedded in a logical snapshot.
+	ExportData(group uint32) (schema, data []byte, err error)
+	// ImportData installs a previously exported schema and posting-list
+	// payload for group.
+	ImportData(group uint32, schema, data []byte) error
+}
+
+// snapshotData is the SnapshotDataSource used by ExportSnapshot/
+// ImportSnapshot; it's nil until something (the worker package, in
+// production) calls RegisterSnapshotDataSource.
+var snapshotData SnapshotDataSource
+
+// RegisterSnapshotDataSource installs the SnapshotDataSource that
+// ExportSnapshot and ImportSnapshot defer to for the schema and
+// posting-list payload. It must be called once, before either is used.
+func RegisterSnapshotDataSource(s SnapshotDataSource) {
+	snapshotData = s
+}
+
+// ExportSnapshot writes a self-describing logical snapshot of this Node's
+// group to w: its schema, posting-list data (via the registered
+// SnapshotDataSource), and the Raft index it was taken at. Unlike the
+// Raft-level snapshots PastLife/Snapshot deal with, a logical snapshot
+// carries no Raft log entries and makes no assumption about the destination
+// cluster's Node.Id, membership, or even RaftEngine — see ImportSnapshot.
+func (n *Node) ExportSnapshot(w io.Writer) error {
+	if snapshotData == nil {
+		return x.Errorf("ExportSnapshot: no SnapshotDataSource registered")
+	}
+	// Capture the applied index before exporting the data it describes.
+	// Applies happen concurrently on another goroutine, so reading
+	// DoneUntil() after ExportData would risk recording an AppliedIndex
+	// newer than what was actually exported, and ImportSnapshot would then
+	// believe the destination has entries it never received.
+	appliedIndex := n.Applied.DoneUntil()
+	schema, data, err := snapshotData.ExportData(n.RaftContext.Group)
+	if err != nil {
+		return err
+	}
+
+	ls := &pb.LogicalSnapshot{
+		Version:      logicalSnapshotVersion,
+		Group:        n.RaftContext.Group,
+		AppliedIndex: appliedIndex,
+		Schema:       schema,
+		Data:         data,
+	}
+	b, err := ls.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ImportSnapshot reads a logical snapshot produced by ExportSnapshot (on
+// this cluster or any other, regardless of Node.Id, group membership, or
+// Raft engine) and installs it: the schema and posting-list payload go
+// through the registered SnapshotDataSource, and the Raft log itself is
+// bootstrapped from scratch, with the imported state installed as the
+// initial raftpb.Snapshot at the exported AppliedIndex. This must be called
+// before SetRaft, since both RaftEngine implementations read their starting
+// point (via raftwal.DiskStorage/raft.Storage) once at startup.
+func (n *Node) ImportSnapshot(r io.Reader) error {
+	if snapshotData == nil {
+		return x.Errorf("ImportSnapshot: no SnapshotDataSource registered")
+	}
+
+	var sizeBuf [8]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return err
+	}
+	b := make([]byte, binary.LittleEndian.Uint64(sizeBuf[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	var ls pb.LogicalSnapshot
+	if err := ls.Unmarshal(b); err != nil {
+		return err
+	}
+	if ls.Version != logicalSnapshotVersion {
+		return x.Errorf("ImportSnapshot: unsupported logical snapshot version %d", ls.Version)
+	}
+	if ls.Group != n.RaftContext.Group {
+		return x.Errorf("ImportSnapshot: snapshot is for group %d, this node is in group %d",
+			ls.Group, n.RaftContext.Group)
+	}
+
+	if err := snapshotData.ImportData(ls.Group, ls.Schema, ls.Data); err != nil {
+		return err
+	}
+
+	// Bootstrap a fresh Raft log at index ls.AppliedIndex, with the just-
+	// installed state as the initial snapshot. The only member we know
+	// about at this point is ourselves; AddToCluster/AddLearnerToCluster is
+	// how the rest of the destination cluster's membership gets layered in
+	// afterwards.
+	snap := raftpb.Snapshot{
+		Metadata: raftpb.SnapshotMetadata{
+			Index:     ls.AppliedIndex,
+			Term:      1,
+			ConfState: raftpb.ConfState{Nodes: []uint64{n.Id}},
+		},
+	}
+	hs := raftpb.HardState{Term: 1, Commit: ls.AppliedIndex}
+	if err := n.Store.Save(hs, nil, snap); err != nil {
+		return err
+	}
+	n.Applied.SetDoneUntil(ls.AppliedIndex)
+	return nil
+}
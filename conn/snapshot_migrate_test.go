@@ -0,0 +1,75 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dgraph-io/dgraph/protos/pb"
+)
+
+// concurrentApplySource simulates an apply landing in the middle of
+// ExportData, the exact race ExportSnapshot's AppliedIndex-before-ExportData
+// ordering is meant to guard against.
+type concurrentApplySource struct {
+	n            *Node
+	duringExport uint64
+	schema, data []byte
+}
+
+func (s *concurrentApplySource) ExportData(group uint32) ([]byte, []byte, error) {
+	s.n.Applied.SetDoneUntil(s.duringExport)
+	return s.schema, s.data, nil
+}
+
+func (s *concurrentApplySource) ImportData(group uint32, schema, data []byte) error {
+	return nil
+}
+
+func TestExportSnapshotAppliedIndexPredatesConcurrentApply(t *testing.T) {
+	n := &Node{RaftContext: &pb.RaftContext{Group: 1}}
+	n.Applied.Init()
+	n.Applied.SetDoneUntil(5)
+
+	src := &concurrentApplySource{n: n, duringExport: 50, schema: []byte("schema"), data: []byte("data")}
+	RegisterSnapshotDataSource(src)
+	defer RegisterSnapshotDataSource(nil)
+
+	var buf bytes.Buffer
+	if err := n.ExportSnapshot(&buf); err != nil {
+		t.Fatalf("ExportSnapshot: %v", err)
+	}
+
+	var size uint64
+	if err := binary.Read(&buf, binary.LittleEndian, &size); err != nil {
+		t.Fatalf("reading length prefix: %v", err)
+	}
+	var ls pb.LogicalSnapshot
+	if err := ls.Unmarshal(buf.Bytes()[:size]); err != nil {
+		t.Fatalf("unmarshalling LogicalSnapshot: %v", err)
+	}
+
+	if ls.AppliedIndex != 5 {
+		t.Fatalf("AppliedIndex = %d, want 5 (the index before ExportData ran, not %d from during it)",
+			ls.AppliedIndex, src.duringExport)
+	}
+	if string(ls.Schema) != "schema" || string(ls.Data) != "data" {
+		t.Fatalf("Schema/Data = %q/%q, want the values ExportData returned", ls.Schema, ls.Data)
+	}
+}